@@ -1,36 +1,77 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
 	"os/user"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"gopkg.in/yaml.v2"
 )
 
 type Config []struct {
-	Hosts []string `yaml:"hosts"`
-	User  string   `yaml:"user"`
-	Pass  string   `yaml:"pass"`
+	Hosts      []string `yaml:"hosts" json:"hosts"`
+	Group      string   `yaml:"group" json:"group"`
+	Port       int      `yaml:"port" json:"port"`
+	User       string   `yaml:"user" json:"user"`
+	Pass       string   `yaml:"pass" json:"pass"`
+	KeyFile    string   `yaml:"keyFile" json:"keyFile"`
+	KeyPass    string   `yaml:"keyPass" json:"keyPass"`
+	Insecure   bool     `yaml:"insecure" json:"insecure"`
+	Become     string   `yaml:"become" json:"become"`
+	BecomePass string   `yaml:"becomePass" json:"becomePass"`
+}
+
+// hostConn pairs an established connection with the become settings that
+// apply to it, since those are per-config rather than per-client.
+type hostConn struct {
+	client     *ssh.Client
+	become     bool
+	becomePass string
+}
+
+// Result is the outcome of running a command on a single host.
+type Result struct {
+	Host     string
+	ExitCode int
+	Duration time.Duration
+	Err      error
 }
 
 var (
-	mode     = flag.String("mode", "exec", "exec or upload")
-	cmd      = flag.String("cmd", "", "cmd")
-	srcFile  = flag.String("srcFile", "", "file")
-	dstFile  = flag.String("dstFile", "", "file")
-	hosts    = flag.String("hosts", "hosts.yml", "hosts")
-	timeout  = flag.Duration("timeout", 10*time.Second, "timeout")
-	logLevel = flag.String("logLevel", "info", "info or debug")
+	mode        = flag.String("mode", "exec", "exec, upload, or download")
+	cmd         = flag.String("cmd", "", "cmd")
+	srcFile     = flag.String("srcFile", "", "file or directory, local for upload, remote for download")
+	dstFile     = flag.String("dstFile", "", "file or directory, remote for upload, local for download")
+	hosts       = flag.String("hosts", "hosts.yml", "hosts")
+	timeout     = flag.Duration("timeout", 10*time.Second, "timeout")
+	logLevel    = flag.String("logLevel", "info", "info or debug")
+	concurrency = flag.Int("concurrency", 10, "max number of hosts handled at once")
+	failFast    = flag.Bool("fail-fast", false, "cancel remaining work on the first host failure")
+	become      = flag.Bool("become", false, "run the command via sudo on every host")
+	checksum    = flag.String("checksum", "", "verify transfers with a checksum and retry on mismatch (sha256)")
+	limit       = flag.String("limit", "", "comma-separated hosts and/or groups to restrict the run to")
 )
 
 func main() {
@@ -42,105 +83,343 @@ func main() {
 
 	log.Debug("Starting ssh executor")
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		log.Warn("Interrupted, cancelling in-flight work")
+		cancel()
+	}()
+
 	services := parseHosts(*hosts)
+	services = filterServices(services, *limit)
 
 	hostCount := getHostCount(services)
+	if hostCount == 0 {
+		log.Warn("no hosts matched, nothing to do")
+		return
+	}
 
 	log.Debugf("Host count: %d", hostCount)
 
-	connections := make(chan *ssh.Client, hostCount)
+	connections := make(chan *hostConn, hostCount)
+	connectSem := make(chan struct{}, *concurrency)
 
+	var connectWg sync.WaitGroup
 	for service, configs := range services {
 		log.Debugf("Creating connections for: %s", service)
-		configs.getConnections(connections)
+		configs.getConnections(ctx, connectSem, connections, &connectWg)
 	}
 
-	done := make(chan bool, hostCount)
-	out := make(chan string, hostCount)
-	err := make(chan string, hostCount)
+	go func() {
+		connectWg.Wait()
+		close(connections)
+	}()
+
+	opSem := make(chan struct{}, *concurrency)
+	var opWg sync.WaitGroup
 
 	switch *mode {
 	case "exec":
-		for i := 0; i < hostCount; i++ {
-			select {
-			case conn := <-connections:
-				go func(conn *ssh.Client) {
-					stdout, stderr := executeCmd(*cmd, conn)
-
-					if len(stdout) != 0 {
-						out <- conn.Conn.RemoteAddr().String() + "\t" + stdout
-					}
-					if len(stderr) != 0 {
-						err <- conn.Conn.RemoteAddr().String() + "\t" + stderr
-					}
+		results := make(chan Result, hostCount)
+		output := &syncWriter{w: os.Stdout}
+
+		for conn := range connections {
+			opWg.Add(1)
+			go func(conn *hostConn) {
+				defer opWg.Done()
+
+				select {
+				case opSem <- struct{}{}:
+					defer func() { <-opSem }()
+				case <-ctx.Done():
+					return
+				}
+
+				host := conn.client.Conn.RemoteAddr().String()
+				start := time.Now()
+				exitCode, err := executeCmd(ctx, *cmd, conn.client, output, host, conn.become, conn.becomePass)
+				if err != nil && *failFast {
+					cancel()
+				}
+
+				results <- Result{
+					Host:     host,
+					ExitCode: exitCode,
+					Duration: time.Since(start),
+					Err:      err,
+				}
+			}(conn)
+		}
+
+		go func() {
+			opWg.Wait()
+			close(results)
+		}()
 
-					done <- true
-				}(conn)
-			case <-time.After(*timeout):
-				log.Warn("Timeout creating connection")
+		for res := range results {
+			if res.Err != nil {
+				log.Errorf("%s\tfailed after %s: %s", res.Host, res.Duration, res.Err.Error())
+			} else {
+				log.Infof("%s\texit code %d (%s)", res.Host, res.ExitCode, res.Duration)
 			}
 		}
 	case "upload":
-		for i := 0; i < hostCount; i++ {
-			select {
-			case conn := <-connections:
-				go func(conn *ssh.Client) {
-					err := SSHCopyFile(*srcFile, *dstFile, conn)
-					if err != nil {
-						log.Error("failed to upload file")
+		for conn := range connections {
+			opWg.Add(1)
+			go func(conn *hostConn) {
+				defer opWg.Done()
+
+				select {
+				case opSem <- struct{}{}:
+					defer func() { <-opSem }()
+				case <-ctx.Done():
+					return
+				}
+
+				if err := SSHCopyFile(ctx, *srcFile, *dstFile, conn.client, *checksum == "sha256"); err != nil {
+					log.Errorf("%s\tfailed to upload: %s", conn.client.Conn.RemoteAddr().String(), err.Error())
+					if *failFast {
+						cancel()
 					}
+				}
+			}(conn)
+		}
 
-					done <- true
-				}(conn)
-			case <-time.After(*timeout):
-				log.Warn("Timeout creating connection")
-			}
+		opWg.Wait()
+	case "download":
+		for conn := range connections {
+			opWg.Add(1)
+			go func(conn *hostConn) {
+				defer opWg.Done()
+
+				select {
+				case opSem <- struct{}{}:
+					defer func() { <-opSem }()
+				case <-ctx.Done():
+					return
+				}
+
+				host := conn.client.Conn.RemoteAddr().String()
+				if err := SSHDownloadFile(ctx, *srcFile, *dstFile, conn.client, host, *checksum == "sha256"); err != nil {
+					log.Errorf("%s\tfailed to download: %s", host, err.Error())
+					if *failFast {
+						cancel()
+					}
+				}
+			}(conn)
 		}
+
+		opWg.Wait()
 	default:
 		log.Error("wrong mode")
 	}
+}
 
-	for i := 0; i < hostCount; i++ {
-		select {
-		case <-done:
-		case <-time.After(*timeout):
-			log.Warn("Operation timeout")
-		}
+// Inventory resolves the services -> host configs this run should target.
+type Inventory interface {
+	Load() (map[string]Config, error)
+}
+
+// parseHosts resolves raw into an Inventory based on its URI scheme
+// (file://, exec://, http(s)://, or a plain path defaulting to file/dir) and
+// loads it.
+func parseHosts(raw string) map[string]Config {
+	inv, err := newInventory(raw)
+	if err != nil {
+		panic(err)
+	}
+
+	services, err := inv.Load()
+	if err != nil {
+		panic(err)
 	}
 
-	close(out)
-	close(err)
+	return services
+}
 
-	log.Info("stdout")
-	for stdout := range out {
-		fmt.Println(stdout)
+// newInventory only treats raw as a URI when it carries one of our known
+// scheme prefixes; everything else is a plain file/directory path. This
+// matters because a bare path can legally contain a colon (e.g.
+// "prod:hosts.yaml") or byte sequences that aren't valid URL escapes, and
+// url.Parse would otherwise misread or reject those.
+func newInventory(raw string) (Inventory, error) {
+	switch {
+	case strings.HasPrefix(raw, "file://"):
+		return fileOrDirInventory(strings.TrimPrefix(raw, "file://"))
+	case strings.HasPrefix(raw, "exec://"):
+		return &execInventory{script: strings.TrimPrefix(raw, "exec://")}, nil
+	case strings.HasPrefix(raw, "http://"), strings.HasPrefix(raw, "https://"):
+		return &httpInventory{url: raw}, nil
+	default:
+		return fileOrDirInventory(raw)
 	}
+}
 
-	log.Info("stderr")
-	for stderr := range err {
-		fmt.Println(stderr)
+func fileOrDirInventory(p string) (Inventory, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dirInventory{path: p}, nil
 	}
+	return &fileInventory{path: p}, nil
 }
 
-func parseHosts(path string) map[string]Config {
-	services := make(map[string]Config)
+// fileInventory is a single YAML file of services -> host configs.
+type fileInventory struct {
+	path string
+}
+
+func (f *fileInventory) Load() (map[string]Config, error) {
+	return loadYAMLFile(f.path)
+}
+
+// dirInventory merges every *.yml/*.yaml fragment in a directory, combining
+// config entries when multiple fragments define the same service.
+type dirInventory struct {
+	path string
+}
+
+func (d *dirInventory) Load() (map[string]Config, error) {
+	entries, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]Config)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if ext != ".yml" && ext != ".yaml" {
+			continue
+		}
 
+		fragment, err := loadYAMLFile(filepath.Join(d.path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for service, configs := range fragment {
+			merged[service] = append(merged[service], configs...)
+		}
+	}
+
+	return merged, nil
+}
+
+func loadYAMLFile(path string) (map[string]Config, error) {
 	filename, err := filepath.Abs(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	yamlFile, err := ioutil.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	err = yaml.Unmarshal(yamlFile, &services)
+	services := make(map[string]Config)
+	if err := yaml.Unmarshal(yamlFile, &services); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// execInventory runs a script and parses its JSON stdout, Ansible dynamic
+// inventory style, as services -> host configs.
+type execInventory struct {
+	script string
+}
+
+func (e *execInventory) Load() (map[string]Config, error) {
+	out, err := exec.Command(e.script).Output()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return services
+	return decodeJSONInventory(out)
+}
+
+// httpInventory fetches the same JSON shape as execInventory from an
+// HTTP(S) endpoint.
+type httpInventory struct {
+	url string
+}
+
+func (h *httpInventory) Load() (map[string]Config, error) {
+	resp, err := http.Get(h.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inventory endpoint %s returned %s", h.url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeJSONInventory(body)
+}
+
+func decodeJSONInventory(data []byte) (map[string]Config, error) {
+	services := make(map[string]Config)
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// filterServices restricts services to the hosts and groups named in limit,
+// a comma-separated list. An empty limit is a no-op.
+func filterServices(services map[string]Config, limit string) map[string]Config {
+	if limit == "" {
+		return services
+	}
+
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(limit, ",") {
+		allowed[strings.TrimSpace(name)] = true
+	}
+
+	filtered := make(map[string]Config)
+	for service, configs := range services {
+		var kept Config
+		for _, config := range configs {
+			if config.Group != "" && allowed[config.Group] {
+				kept = append(kept, config)
+				continue
+			}
+
+			var hosts []string
+			for _, host := range config.Hosts {
+				if allowed[host] {
+					hosts = append(hosts, host)
+				}
+			}
+			if len(hosts) > 0 {
+				config.Hosts = hosts
+				kept = append(kept, config)
+			}
+		}
+		if len(kept) > 0 {
+			filtered[service] = kept
+		}
+	}
+
+	return filtered
 }
 
 func getHostCount(services map[string]Config) (count int) {
@@ -153,58 +432,293 @@ func getHostCount(services map[string]Config) (count int) {
 	return count
 }
 
-func (c *Config) getConnections(connections chan *ssh.Client) {
+// getConnections dials every host in c, at most cap(sem) at a time, and sends
+// the resulting clients to connections. It returns immediately; dialing
+// happens in the background and is tracked by wg.
+func (c *Config) getConnections(ctx context.Context, sem chan struct{}, connections chan *hostConn, wg *sync.WaitGroup) {
 	for _, config := range *c {
+		// Auth methods are tried in the same order OpenSSH clients prefer: agent, then key, then password.
+		var authMethods []ssh.AuthMethod
+
+		if am, err := agentAuthMethod(); err == nil {
+			authMethods = append(authMethods, am)
+		} else {
+			log.Debugf("ssh-agent auth not available: %s", err.Error())
+		}
+
+		if config.KeyFile != "" {
+			am, err := keyAuthMethod(config.KeyFile, config.KeyPass)
+			if err != nil {
+				log.Errorf("failed to load key %s: %s", config.KeyFile, err.Error())
+			} else {
+				authMethods = append(authMethods, am)
+			}
+		}
+
+		if config.Pass != "" {
+			authMethods = append(authMethods, ssh.Password(config.Pass))
+		}
+
+		hostKeyCallback, err := makeHostKeyCallback(config.Insecure)
+		if err != nil {
+			log.Error("failed to set up host key verification: " + err.Error())
+			continue
+		}
+
 		sshConfig := &ssh.ClientConfig{
-			User: config.User,
-			Auth: []ssh.AuthMethod{
-				ssh.Password(config.Pass),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			User:            config.User,
+			Auth:            authMethods,
+			HostKeyCallback: hostKeyCallback,
+		}
+
+		becomeEnabled := *become || config.Become == "sudo"
+		becomePass := config.BecomePass
+		if becomePass == "" {
+			becomePass = config.Pass
 		}
+
 		for _, host := range config.Hosts {
-			go func(host string, conf *ssh.ClientConfig) {
-				connection := createConnection(host, sshConfig)
+			wg.Add(1)
+			go func(host string, conf *ssh.ClientConfig, port int) {
+				defer wg.Done()
+
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					return
+				}
+
+				connection := createConnection(ctx, host, port, conf)
 				if connection != nil {
-					connections <- connection
+					connections <- &hostConn{
+						client:     connection,
+						become:     becomeEnabled,
+						becomePass: becomePass,
+					}
 				}
-			}(host, sshConfig)
+			}(host, sshConfig, config.Port)
 		}
 	}
 }
 
-func createConnection(host string, conf *ssh.ClientConfig) *ssh.Client {
-	conn, err := ssh.Dial("tcp", host+":22", conf)
+// agentAuthMethod connects to the agent listening on SSH_AUTH_SOCK, if any.
+func agentAuthMethod() (ssh.AuthMethod, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	agentClient := agent.NewClient(conn)
+	return ssh.PublicKeysCallback(agentClient.Signers), nil
+}
+
+// keyAuthMethod loads a private key, decrypting it with passphrase if one is set.
+func keyAuthMethod(keyFile, passphrase string) (ssh.AuthMethod, error) {
+	if strings.HasPrefix(keyFile, "~/") {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		keyFile = filepath.Join(usr.HomeDir, keyFile[1:])
+	}
+
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.PublicKeys(signer), nil
+}
+
+// makeHostKeyCallback verifies hosts against ~/.ssh/known_hosts unless insecure is set.
+func makeHostKeyCallback(insecure bool) (ssh.HostKeyCallback, error) {
+	if insecure {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	return knownhosts.New(filepath.Join(usr.HomeDir, ".ssh", "known_hosts"))
+}
+
+func createConnection(ctx context.Context, host string, port int, conf *ssh.ClientConfig) *ssh.Client {
+	if port == 0 {
+		port = 22
+	}
+
+	addr := fmt.Sprintf("%s:%d", host, port)
+
+	dialer := net.Dialer{Timeout: *timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		log.Error(err.Error())
+		return nil
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, conf)
 	if err != nil {
+		netConn.Close()
 		log.Error(err.Error())
 		return nil
 	}
 
-	return conn
+	return ssh.NewClient(sshConn, chans, reqs)
+}
+
+// syncWriter serializes writes from multiple hosts into a single shared writer.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// sudoPromptMarkers are the classic sudo responses when no valid password
+// was supplied, seen on both Debian- and RHEL-derived systems.
+var sudoPromptMarkers = []string{
+	"sudo: a password is required",
+	"Sorry, try again",
 }
 
-func executeCmd(cmd string, conn *ssh.Client) (stdout, stderr string) {
+// executeCmd streams stdout/stderr to out line-by-line, prefixed with host, and
+// returns the remote exit code. A non-nil err means the command could not be
+// run at all (session/transport failure), as opposed to a nonzero exit code.
+// If ctx is cancelled before the command finishes, the session is torn down
+// and ctx.Err() is returned. When become is set, cmd runs under sudo with
+// becomePass fed over stdin, and a rejected password fails fast instead of
+// hanging on sudo's own password prompt.
+func executeCmd(ctx context.Context, cmd string, conn *ssh.Client, out io.Writer, host string, become bool, becomePass string) (exitCode int, err error) {
 	session, err := conn.NewSession()
 	if err != nil {
-		log.Error("Failed to create session" + err.Error())
+		return -1, err
 	}
 	defer session.Close()
 
-	var stdoutBuf, stderrBuf bytes.Buffer
-	session.Stdout = &stdoutBuf
-	session.Stderr = &stderrBuf
-	session.Run(cmd)
+	var stdin io.WriteCloser
+	var becomeFailed chan error
+	if become {
+		cmd = fmt.Sprintf("sudo -S -p '' -- sh -c '%s'", cmd)
+
+		stdin, err = session.StdinPipe()
+		if err != nil {
+			return -1, err
+		}
+		becomeFailed = make(chan error, 1)
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return -1, err
+	}
+
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		return -1, err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go streamLines(stdout, out, host, &wg, becomeFailed)
+	go streamLines(stderr, out, host, &wg, becomeFailed)
+
+	if err := session.Start(cmd); err != nil {
+		return -1, err
+	}
+
+	if become {
+		if _, err := fmt.Fprintln(stdin, becomePass); err != nil {
+			return -1, err
+		}
+		stdin.Close()
+	}
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- session.Wait() }()
+
+	select {
+	case <-ctx.Done():
+		session.Close()
+		wg.Wait()
+		return -1, ctx.Err()
+	case err := <-becomeFailed:
+		session.Close()
+		wg.Wait()
+		return -1, err
+	case err := <-waitErr:
+		wg.Wait()
+		if err != nil {
+			if exitErr, ok := err.(*ssh.ExitError); ok {
+				return exitErr.ExitStatus(), nil
+			}
+			return -1, err
+		}
+		return 0, nil
+	}
+}
+
+// streamLines copies r line-by-line to out, prefixing each line with host. If
+// becomeFailed is non-nil, a line matching a sudoPromptMarkers entry is also
+// reported there so the caller can fail fast instead of waiting on the hang.
+func streamLines(r io.Reader, out io.Writer, host string, wg *sync.WaitGroup, becomeFailed chan<- error) {
+	defer wg.Done()
 
-	return stdoutBuf.String(), stderrBuf.String()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintf(out, "%s\t%s\n", host, line)
+
+		if becomeFailed == nil {
+			continue
+		}
+		for _, marker := range sudoPromptMarkers {
+			if strings.Contains(line, marker) {
+				select {
+				case becomeFailed <- fmt.Errorf("sudo authentication failed: %s", line):
+				default:
+				}
+				break
+			}
+		}
+	}
 }
 
-func SSHCopyFile(srcPath, dstPath string, conn *ssh.Client) error {
-	// open an SFTP session over an existing ssh connection.
-	sftp, err := sftp.NewClient(conn)
+// SSHCopyFile uploads srcPath to dstPath over SFTP. If srcPath is a directory
+// its tree is mirrored under dstPath, preserving file mode and mtime. When
+// checksum is set, each transferred file is re-read and compared against its
+// local sha256 sum, retrying once on mismatch.
+func SSHCopyFile(ctx context.Context, srcPath, dstPath string, conn *ssh.Client, checksum bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	client, err := sftp.NewClient(conn)
 	if err != nil {
 		return err
 	}
-	defer sftp.Close()
+	defer client.Close()
 
 	if strings.HasPrefix(srcPath, "~/") {
 		usr, err := user.Current()
@@ -213,31 +727,234 @@ func SSHCopyFile(srcPath, dstPath string, conn *ssh.Client) error {
 		}
 		srcPath = filepath.Join(usr.HomeDir, srcPath[1:])
 	}
-	// Open the source file
-	srcFile, err := os.Open(srcPath)
+
+	if strings.HasPrefix(dstPath, "~/") {
+		dstPath = path.Join("/home/", conn.Conn.User(), dstPath[1:])
+	}
+
+	srcInfo, err := os.Stat(srcPath)
 	if err != nil {
 		return err
 	}
-	defer srcFile.Close()
 
-	if strings.HasPrefix(dstPath, "~/") {
-		dstPath = filepath.Join("/home/", conn.Conn.User(), dstPath[1:])
+	if !srcInfo.IsDir() {
+		return uploadFile(ctx, client, srcPath, dstPath, srcInfo, checksum)
 	}
-	err = sftp.MkdirAll(filepath.Dir(dstPath))
+
+	return filepath.Walk(srcPath, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rel, err := filepath.Rel(srcPath, localPath)
+		if err != nil {
+			return err
+		}
+		remotePath := path.Join(dstPath, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			return client.MkdirAll(remotePath)
+		}
+		return uploadFile(ctx, client, localPath, remotePath, info, checksum)
+	})
+}
+
+// uploadFile copies a single local file to remotePath, then applies mode and
+// mtime from info. With checksum set, it retries the transfer once if the
+// remote sha256 sum doesn't match.
+func uploadFile(ctx context.Context, client *sftp.Client, localPath, remotePath string, info os.FileInfo, checksum bool) error {
+	if err := client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := copyLocalToRemote(client, localPath, remotePath, info); err != nil {
+			return err
+		}
+
+		if !checksum {
+			return nil
+		}
+
+		match, err := remoteMatchesLocalChecksum(client, localPath, remotePath)
+		if err != nil {
+			return err
+		}
+		if match {
+			return nil
+		}
+		if attempt > 0 {
+			return fmt.Errorf("checksum mismatch for %s after retry", remotePath)
+		}
+		log.Warnf("checksum mismatch for %s, retrying", remotePath)
+	}
+}
+
+func copyLocalToRemote(client *sftp.Client, localPath, remotePath string, info os.FileInfo) error {
+	srcFile, err := os.Open(localPath)
 	if err != nil {
 		return err
 	}
+	defer srcFile.Close()
 
-	// Create the destination file
-	dstFile, err := sftp.Create(dstPath)
+	dstFile, err := client.Create(remotePath)
 	if err != nil {
 		return err
 	}
 	defer dstFile.Close()
 
-	// write to file
 	if _, err := dstFile.ReadFrom(srcFile); err != nil {
 		return err
 	}
+
+	if err := client.Chmod(remotePath, info.Mode()); err != nil {
+		return err
+	}
+	return client.Chtimes(remotePath, info.ModTime(), info.ModTime())
+}
+
+// SSHDownloadFile pulls srcPath from the remote host down into
+// dstPath/host/..., mirroring directories and preserving mode and mtime. When
+// checksum is set, each transferred file is re-read and compared against its
+// remote sha256 sum, retrying once on mismatch.
+func SSHDownloadFile(ctx context.Context, srcPath, dstPath string, conn *ssh.Client, host string, checksum bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if strings.HasPrefix(srcPath, "~/") {
+		srcPath = path.Join("/home/", conn.Conn.User(), srcPath[1:])
+	}
+
+	hostDir := filepath.Join(dstPath, host)
+
+	walker := client.Walk(srcPath)
+	for walker.Step() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := walker.Err(); err != nil {
+			return err
+		}
+
+		info := walker.Stat()
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), srcPath), "/")
+		if rel == "" && !info.IsDir() {
+			rel = path.Base(srcPath)
+		}
+		localPath := filepath.Join(hostDir, filepath.FromSlash(rel))
+
+		if info.IsDir() {
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := downloadFile(client, walker.Path(), localPath, info, checksum); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// downloadFile copies a single remote file to localPath, then applies mode
+// and mtime from info. With checksum set, it retries the transfer once if
+// the local sha256 sum doesn't match.
+func downloadFile(client *sftp.Client, remotePath, localPath string, info os.FileInfo, checksum bool) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := copyRemoteToLocal(client, remotePath, localPath, info); err != nil {
+			return err
+		}
+
+		if !checksum {
+			return nil
+		}
+
+		match, err := remoteMatchesLocalChecksum(client, localPath, remotePath)
+		if err != nil {
+			return err
+		}
+		if match {
+			return nil
+		}
+		if attempt > 0 {
+			return fmt.Errorf("checksum mismatch for %s after retry", localPath)
+		}
+		log.Warnf("checksum mismatch for %s, retrying", localPath)
+	}
+}
+
+func copyRemoteToLocal(client *sftp.Client, remotePath, localPath string, info os.FileInfo) error {
+	srcFile, err := client.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := srcFile.WriteTo(dstFile); err != nil {
+		return err
+	}
+
+	if err := dstFile.Chmod(info.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(localPath, info.ModTime(), info.ModTime())
+}
+
+// remoteMatchesLocalChecksum compares the sha256 sums of a local and a
+// remote file.
+func remoteMatchesLocalChecksum(client *sftp.Client, localPath, remotePath string) (bool, error) {
+	localSum, err := fileChecksum(localPath)
+	if err != nil {
+		return false, err
+	}
+
+	remoteFile, err := client.Open(remotePath)
+	if err != nil {
+		return false, err
+	}
+	defer remoteFile.Close()
+
+	remoteHash := sha256.New()
+	if _, err := io.Copy(remoteHash, remoteFile); err != nil {
+		return false, err
+	}
+
+	return localSum == hex.EncodeToString(remoteHash.Sum(nil)), nil
+}
+
+func fileChecksum(localPath string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}